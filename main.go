@@ -22,17 +22,17 @@
 // system tor service and have 'about:tor' and 'New Identity' work while
 // disallowing scary control port commands".  But on a positive note, it's not
 // a collection of bash and doesn't call netcat.
+//
+// The protocol handling and authentication this binary needs live in the
+// torctl package; main is a thin wrapper that reads the filter config,
+// listens for application connections, and applies the configured policy
+// to each one.
 package main
 
 import (
 	"bufio"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
@@ -40,6 +40,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/david415/or-ctl-filter/torctl"
 )
 
 const (
@@ -48,284 +51,114 @@ const (
 
 	controlSocketFile = "/var/run/tor/control"
 	torControlAddr    = "127.0.0.1:8851" // Match ControlPort in torrc-defaults.
-
-	cmdProtocolInfo  = "PROTOCOLINFO"
-	cmdAuthenticate  = "AUTHENTICATE"
-	cmdAuthChallenge = "AUTHCHALLENGE"
-	cmdGetInfo       = "GETINFO"
-	cmdSignal        = "SIGNAL"
-
-	argSignalNewnym = "NEWNYM"
-	argGetinfoSocks = "net/listeners/socks"
-	argServerHash   = "SERVERHASH="
-	argServerNonce  = "SERVERNONCE="
-
-	respProtocolInfoAuth       = "250-AUTH"
-	respProtocolInfoMethods    = "METHODS="
-	respProtocolInfoCookieFile = "COOKIEFILE="
-
-	respAuthChallenge = "250 AUTHCHALLENGE "
-
-	authMethodNull       = "NULL"
-	authMethodCookie     = "COOKIE"
-	authMethodSafeCookie = "SAFECOOKIE"
-
-	authNonceLength   = 32
-	authServerHashKey = "Tor safe cookie authentication server-to-controller hash"
-	authClientHashKey = "Tor safe cookie authentication controller-to-server hash"
-
-	errAuthenticationRequired = "514 Authentication required\n"
-	errUnrecognizedCommand    = "510 Unrecognized command\n"
 )
 
 var filteredControlAddr *net.UnixAddr
 
+// FilterConfig holds the policy rules applied to each direction of a
+// filtered control port connection.  Each rule is matched by command
+// keyword and, optionally, a regexp over the command's arguments; see
+// PolicyRule and PolicyEngine.
 type FilterConfig struct {
-	ClientAllowed             []string          `json:"client-allowed"`
-	ClientAllowedPrefixes     []string          `json:"client-allowed-prefixes"`
-	ClientReplacements        map[string]string `json:"client-replacements"`
-	ClientReplacementPrefixes map[string]string `json:"client-replacement-prefixes"`
-
-	ServerAllowed             []string          `json:"server-allowed"`
-	ServerAllowedPrefixes     []string          `json:"server-allowed-prefixes"`
-	ServerReplacements        map[string]string `json:"server-replacements"`
-	ServerReplacementPrefixes map[string]string `json:"server-replacement-prefixes"`
+	ClientPolicy []PolicyRule `json:"client-policy"`
+	ServerPolicy []PolicyRule `json:"server-policy"`
+
+	// OnionPolicy, if set, routes ADD_ONION/DEL_ONION/ONION_CLIENT_AUTH_ADD
+	// through an OnionManager instead of ClientPolicy, so that those
+	// commands can be scoped per connecting client.
+	OnionPolicy *OnionPolicy `json:"onion-policy"`
+
+	// Socks, if set, also runs the SOCKS5 authenticator/redispatcher mode
+	// described by ServeSocks, identifying connecting applications by their
+	// SOCKS5 username so control port connections from the same app (see
+	// AppIdentityRegistry) can be scoped under that identity instead of
+	// their ephemeral source port.
+	Socks *SocksConfig `json:"socks"`
+
+	// RateLimits configures a per-client token bucket for each listed
+	// command keyword; commands with no entry are not rate limited.
+	RateLimits map[string]RateLimitSpec `json:"rate-limits"`
+
+	// NewnymDebounce, if non-zero, coalesces a "SIGNAL NEWNYM" command from
+	// a client arriving less than this duration (a Go duration string, e.g.
+	// "10s") after the last one forwarded for that client.
+	NewnymDebounce string `json:"newnym-debounce"`
 }
 
-func hasReplacementCommand(cmd string, replacements map[string]string) (string, bool) {
-	log.Print("maybeReplaceCommand\n")
-	replacement, ok := replacements[cmd]
-	if ok {
-		log.Printf("%v true", replacement)
-		return replacement, true
-	} else {
-		log.Printf("%v false", replacement)
-		return cmd, false
-	}
-}
-
-func hasReplacementPrefix(cmd string, replacements map[string]string) (string, bool) {
-	log.Print("hasReplacementPrefix")
-	for prefix, replacement := range replacements {
-		if strings.HasPrefix(cmd, prefix) {
-			log.Print("true")
-			return replacement, true
-		}
-	}
-	log.Print("false")
-	return cmd, false
-}
+const (
+	cmdAddOnion           = "ADD_ONION"
+	cmdDelOnion           = "DEL_ONION"
+	cmdOnionClientAuthAdd = "ONION_CLIENT_AUTH_ADD"
 
-func isCommandAllowed(cmd string, allowed []string) bool {
-	log.Print("isCommandAllowed")
-	for i := 0; i < len(allowed); i++ {
-		if cmd == allowed[i] {
-			log.Print("true")
-			return true
-		}
-	}
-	log.Print("false")
-	return false
-}
+	cmdSignal       = "SIGNAL"
+	argSignalNewnym = "NEWNYM"
+)
 
-func isPrefixAllowed(cmd string, allowed []string) bool {
-	log.Print("isPrefixAllowed")
-	for i := 0; i < len(allowed); i++ {
-		if strings.HasPrefix(cmd, allowed[i]) {
-			log.Print("true")
-			return true
-		}
-	}
-	log.Print("false")
-	return false
+// filterDeps bundles the optional, shared-across-connections state
+// filterConnection consults: onion service scoping, SOCKS5-derived app
+// identities, and per-command rate limiting.  Any field may be nil to
+// disable that feature.
+type filterDeps struct {
+	onionMgr        *OnionManager
+	identities      *AppIdentityRegistry
+	rateLimiter     *RateLimiter
+	newnymDebouncer *NewnymDebouncer
 }
 
-func readAuthCookie(path string) ([]byte, error) {
-	log.Print("read auth cookie")
-	// Read the cookie auth file.
-	cookie, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("reading cookie auth file: %s", err)
-	}
-	return cookie, nil
-}
+func filterConnection(appConn net.Conn, filterConfig *FilterConfig, deps *filterDeps) {
+	defer appConn.Close()
 
-func authSafeCookie(conn net.Conn, connReader *bufio.Reader, cookie []byte) ([]byte, error) {
-	log.Print("auth safe cookie")
-	clientNonce := make([]byte, authNonceLength)
-	if _, err := rand.Read(clientNonce); err != nil {
-		return nil, fmt.Errorf("generating AUTHCHALLENGE nonce: %s", err)
+	clientAddr := appConn.RemoteAddr()
+	clientKey := clientAddr.String()
+	if deps.identities != nil {
+		if id := deps.identities.Lookup(appConn); id != "" {
+			clientKey = id
+		}
 	}
-	clientNonceStr := hex.EncodeToString(clientNonce)
+	log.Printf("New app connection from: %s\n", clientAddr)
 
-	// Send and process the AUTHCHALLENGE.
-	authChallengeReq := []byte(fmt.Sprintf("%s %s %s\n", cmdAuthChallenge, authMethodSafeCookie, clientNonceStr))
-	if _, err := conn.Write(authChallengeReq); err != nil {
-		return nil, fmt.Errorf("writing AUTHCHALLENGE request: %s", err)
-	}
-	line, err := connReader.ReadBytes('\n')
-	if err != nil {
-		return nil, fmt.Errorf("reading AUTHCHALLENGE response: %s", err)
-	}
-	lineStr := strings.TrimSpace(string(line))
-	respStr := strings.TrimPrefix(lineStr, respAuthChallenge)
-	if respStr == lineStr {
-		return nil, fmt.Errorf("parsing AUTHCHALLENGE response")
-	}
-	splitResp := strings.SplitN(respStr, " ", 2)
-	if len(splitResp) != 2 {
-		return nil, fmt.Errorf("parsing AUTHCHALLENGE response")
-	}
-	hashStr := strings.TrimPrefix(splitResp[0], argServerHash)
-	serverHash, err := hex.DecodeString(hashStr)
-	if err != nil {
-		return nil, fmt.Errorf("decoding AUTHCHALLENGE ServerHash: %s", err)
-	}
-	serverNonceStr := strings.TrimPrefix(splitResp[1], argServerNonce)
-	serverNonce, err := hex.DecodeString(serverNonceStr)
+	torConn, err := net.DialUnix("unix", nil, filteredControlAddr)
 	if err != nil {
-		return nil, fmt.Errorf("decoding AUTHCHALLENGE ServerNonce: %s", err)
-	}
-
-	// Validate the ServerHash.
-	m := hmac.New(sha256.New, []byte(authServerHashKey))
-	m.Write([]byte(cookie))
-	m.Write([]byte(clientNonce))
-	m.Write([]byte(serverNonce))
-	dervServerHash := m.Sum(nil)
-	if !hmac.Equal(serverHash, dervServerHash) {
-		return nil, fmt.Errorf("AUTHCHALLENGE ServerHash is invalid")
-	}
-
-	// Calculate the ClientHash.
-	m = hmac.New(sha256.New, []byte(authClientHashKey))
-	m.Write([]byte(cookie))
-	m.Write([]byte(clientNonce))
-	m.Write([]byte(serverNonce))
-
-	return m.Sum(nil), nil
-}
-
-func authenticate(torConn net.Conn, torConnReader *bufio.Reader, appConn net.Conn, appConnReader *bufio.Reader) error {
-	var canNull, canCookie, canSafeCookie bool
-	var cookiePath string
-
-	log.Print("authenticate")
-	// Figure out the best auth method, and where the cookie is if any.
-	protocolInfoReq := []byte(fmt.Sprintf("%s\n", cmdProtocolInfo))
-	if _, err := torConn.Write(protocolInfoReq); err != nil {
-		return fmt.Errorf("writing PROTOCOLINFO request: %s", err)
-	}
-	for {
-		line, err := torConnReader.ReadBytes('\n')
-		if err != nil {
-			return fmt.Errorf("reading PROTOCOLINFO response: %s", err)
-		}
-		lineStr := strings.TrimSpace(string(line))
-		if !strings.HasPrefix(lineStr, "250") {
-			return fmt.Errorf("parsing PROTOCOLINFO response")
-		} else if lineStr == "250 OK" {
-			break
-		}
-		splitResp := strings.SplitN(lineStr, " ", 3)
-		if splitResp[0] == respProtocolInfoAuth {
-			if len(splitResp) == 1 {
-				continue
-			}
-
-			methodsStr := strings.TrimPrefix(splitResp[1], respProtocolInfoMethods)
-			if methodsStr == splitResp[1] {
-				continue
-			}
-			methods := strings.Split(methodsStr, ",")
-			for _, method := range methods {
-				switch method {
-				case authMethodNull:
-					canNull = true
-				case authMethodCookie:
-					canCookie = true
-				case authMethodSafeCookie:
-					canSafeCookie = true
-				}
-			}
-			log.Print("after method for loop")
-			if (canCookie || canSafeCookie) && len(splitResp) == 3 {
-				log.Print("can cookie")
-				cookiePathStr := strings.TrimPrefix(splitResp[2], respProtocolInfoCookieFile)
-				if cookiePathStr == splitResp[2] {
-					continue
-				}
-				cookiePath, err = strconv.Unquote(cookiePathStr)
-				if err != nil {
-					continue
-				}
-			}
-			log.Print("end?")
-		}
+		log.Printf("Failed to connect to the tor control port: %s\n", err)
+		return
 	}
-	log.Print("end of auth detection")
+	tc := torctl.NewConn(torConn)
+	defer tc.Close()
 
-	// Authenticate using the best possible authentication method.
-	var authReq []byte
-	if canNull {
-		if _, err := torConn.Write([]byte(cmdAuthenticate + "\n")); err != nil {
-			return fmt.Errorf("writing AUTHENTICATE request: %s", err)
-		}
-	} else if (canCookie || canSafeCookie) && (cookiePath != "") {
-		// Read the auth cookie.
-		cookie, err := readAuthCookie(cookiePath)
-		if err != nil {
-			return err
-		}
-		if canSafeCookie {
-			cookie, err = authSafeCookie(torConn, torConnReader, cookie)
-			if err != nil {
-				return err
-			}
-		}
-		cookieStr := hex.EncodeToString(cookie)
-		authReq = []byte(fmt.Sprintf("%s %s\n", cmdAuthenticate, cookieStr))
-		if _, err := torConn.Write(authReq); err != nil {
-			return fmt.Errorf("writing AUTHENTICATE request: %s", err)
-		}
-	} else {
-		return fmt.Errorf("no supported authentication methods")
-	}
-	authResp, err := torConnReader.ReadBytes('\n')
+	clientPolicy, err := NewPolicyEngine(filterConfig.ClientPolicy)
 	if err != nil {
-		return fmt.Errorf("reading AUTHENTICATE response: %s", err)
+		log.Printf("Failed to build client policy: %s\n", err)
+		return
 	}
-	return nil
-}
-
-func syncedWrite(l *sync.Mutex, conn net.Conn, buf []byte) (int, error) {
-	log.Print("synced write")
-	l.Lock()
-	defer l.Unlock()
-	return conn.Write(buf)
-}
-
-func filterConnection(appConn net.Conn, filterConfig *FilterConfig) {
-	defer appConn.Close()
-
-	clientAddr := appConn.RemoteAddr()
-	log.Printf("New app connection from: %s\n", clientAddr)
-
-	torConn, err := net.DialUnix("unix", nil, filteredControlAddr)
+	serverPolicy, err := NewPolicyEngine(filterConfig.ServerPolicy)
 	if err != nil {
-		log.Printf("Failed to connect to the tor control port: %s\n", err)
+		log.Printf("Failed to build server policy: %s\n", err)
 		return
 	}
-	defer torConn.Close()
 
-	// Authenticate with the real control port, and wait for the application to
-	// authenticate.
-	torConnReader := bufio.NewReader(torConn)
-	appConnReader := bufio.NewReader(appConn)
-	if err = authenticate(torConn, torConnReader, appConn, appConnReader); err != nil {
+	// Authenticate with the real control port.  filterConnection keeps
+	// using tc.Reader() afterwards rather than wrapping torConn again, since
+	// it may already hold buffered bytes read during authentication.
+	if err = tc.Authenticate(); err != nil {
 		log.Printf("Failed to authenticate: %s\n", err)
 		return
 	}
+	torConnReader := tc.Reader()
+	appConnReader := bufio.NewReader(appConn)
+
+	// pendingCmds carries the keyword of every command forwarded to Tor, in
+	// order, so the reply side can tell which forwarded command a given
+	// reply belongs to: Tor replies to a connection's commands strictly in
+	// the order they were sent (control-spec.txt section 2.3), even though
+	// asynchronous (650) event replies may be interleaved at any point, so
+	// the next non-650 reply always answers the oldest still-unanswered
+	// entry here, never just "the most recent onion command" regardless of
+	// what else was pipelined in between.  It is only needed when onion
+	// filtering is configured, since that's the only consumer.
+	var pendingCmds chan string
+	if deps.onionMgr != nil {
+		pendingCmds = make(chan string, 64)
+	}
 
 	// Start filtering commands as appropriate.
 	errChan := make(chan error, 2)
@@ -343,121 +176,131 @@ func filterConnection(appConn net.Conn, filterConfig *FilterConfig) {
 	go func() {
 		defer wg.Done()
 		defer appConn.Close()
-		defer torConn.Close()
+		defer tc.Close()
 
 		for {
-			line, err := torConnReader.ReadBytes('\n')
+			reply, err := torctl.ReadReply(torConnReader)
 			if err != nil {
 				errChan <- err
 				break
 			}
-			lineStr := strings.TrimSpace(string(line))
-			log.Printf("meow A<-T: [%s]\n", lineStr)
+			last := reply.Lines[len(reply.Lines)-1]
+			log.Printf("A<-T: [%03d%c%s]\n", last.Code, last.Sep, last.Text)
 
-			replacement, ok := hasReplacementPrefix(lineStr, filterConfig.ServerReplacementPrefixes)
-			if ok {
-				log.Printf("replacing %s with %s", lineStr, replacement)
-				if _, err = writeAppConn([]byte(replacement + "\n")); err != nil { // XXX need \n ?
-					errChan <- err
-					break
+			if pendingCmds != nil && reply.Code() != 650 {
+				if keyword := <-pendingCmds; keyword == cmdAddOnion {
+					deps.onionMgr.RecordAddOnionReply(clientKey, reply)
 				}
-				continue
 			}
 
-			replacement, ok = hasReplacementCommand(lineStr, filterConfig.ServerReplacements)
-			if ok {
-				log.Printf("replacing %s with %s", lineStr, replacement)
-				if _, err = writeAppConn([]byte(replacement + "\n")); err != nil { // XXX need \n ?
+			action, rewrite := serverPolicy.Eval(strconv.Itoa(last.Code), []string{last.Text})
+			switch action {
+			case PolicyRewrite:
+				log.Printf("rewriting reply %d to %q", last.Code, rewrite)
+				if _, err = writeAppConn([]byte(rewrite + "\r\n")); err != nil {
 					errChan <- err
-					break
 				}
-				continue
-			}
-
-			if isCommandAllowed(lineStr, filterConfig.ServerAllowed) {
-				log.Printf("%s is allowed", lineStr)
-				if _, err = writeAppConn([]byte(line)); err != nil { // XXX need \n ?
+			case PolicyAllow:
+				if _, err = writeAppConn(reply.Bytes()); err != nil {
 					errChan <- err
-					break
 				}
-				continue
-			}
-
-			if isPrefixAllowed(lineStr, filterConfig.ServerAllowedPrefixes) {
-				log.Printf("%s has an allowed prefix", lineStr)
-				if _, err = writeAppConn([]byte(line)); err != nil { // XXX need \n ?
+			default:
+				log.Printf("A<-T denied [%03d%c%s]", last.Code, last.Sep, last.Text)
+				if _, err = writeAppConn([]byte("250 OK\r\n")); err != nil {
 					errChan <- err
-					break
 				}
-				continue
 			}
-
-			log.Printf("A<-T denied %s", lineStr)
-			if _, err = writeAppConn([]byte("250 OK\n")); err != nil {
-				errChan <- err
+			if err != nil {
 				break
 			}
-
 		}
 	}()
 
 	// application to tor chatter
 	go func() {
 		defer wg.Done()
-		defer torConn.Close()
+		defer tc.Close()
 		defer appConn.Close()
 
+	cmdLoop:
 		for {
-			line, err := appConnReader.ReadBytes('\n')
+			cmd, err := torctl.ReadCmd(appConnReader)
 			if err != nil {
 				errChan <- err
 				break
 			}
-			lineStr := strings.TrimSpace(string(line))
-			log.Printf("A->T: [%s]\n", lineStr)
-
-			replacement, ok := hasReplacementPrefix(lineStr, filterConfig.ClientReplacementPrefixes)
-			if ok {
-				log.Printf("replacing %s with %s", lineStr, replacement)
-				if _, err = torConn.Write([]byte(replacement + "\n")); err != nil { // XXX need \n ?
-					errChan <- err
-					break
+			log.Printf("A->T: [%s %s]\n", cmd.Keyword, strings.Join(cmd.Args, " "))
+
+			if deps.rateLimiter != nil {
+				if allowed, onExceed := deps.rateLimiter.Allow(clientKey, cmd.Keyword); !allowed {
+					switch onExceed {
+					case onExceedStall:
+						deps.rateLimiter.Wait(clientKey, cmd.Keyword)
+					case onExceedDrop:
+						log.Printf("A->T: rate limited (drop): [%s]\n", cmd.Keyword)
+						continue
+					default: // onExceedDeny
+						log.Printf("A->T: rate limited (deny): [%s]\n", cmd.Keyword)
+						if _, err = writeAppConn([]byte("250 OK\r\n")); err != nil {
+							errChan <- err
+							break cmdLoop
+						}
+						continue
+					}
 				}
-				continue
 			}
 
-			replacement, ok = hasReplacementCommand(lineStr, filterConfig.ClientReplacements)
-			if ok {
-				log.Printf("replacing %s with %s", lineStr, replacement)
-				if _, err = torConn.Write([]byte(replacement + "\n")); err != nil { // XXX need \n ?
-					errChan <- err
-					break
+			if deps.newnymDebouncer != nil && cmd.Keyword == cmdSignal && len(cmd.Args) == 1 && cmd.Args[0] == argSignalNewnym {
+				if deps.newnymDebouncer.ShouldCoalesce(clientKey) {
+					log.Printf("A->T: coalescing SIGNAL NEWNYM for %s\n", clientKey)
+					if _, err = writeAppConn([]byte("250 OK\r\n")); err != nil {
+						errChan <- err
+						break
+					}
+					continue
 				}
-				continue
 			}
 
-			if isCommandAllowed(lineStr, filterConfig.ClientAllowed) {
-				log.Printf("%s is allowed", lineStr)
-				if _, err = torConn.Write([]byte(line)); err != nil { // XXX need \n ?
+			if deps.onionMgr != nil && isOnionCommand(cmd.Keyword) {
+				allowed, toSend := filterOnionCommand(deps.onionMgr, clientKey, cmd)
+				if !allowed {
+					log.Printf("A->T: denied onion command: [%s]\n", cmd.Keyword)
+					if _, err = writeAppConn([]byte("250 OK\r\n")); err != nil {
+						errChan <- err
+						break
+					}
+					continue
+				}
+				if _, err = tc.NetConn().Write(toSend.Bytes()); err != nil {
 					errChan <- err
 					break
 				}
+				pendingCmds <- cmd.Keyword
 				continue
 			}
 
-			if isPrefixAllowed(lineStr, filterConfig.ClientAllowedPrefixes) {
-				log.Printf("%s has an allowed prefix", lineStr)
-				if _, err = torConn.Write([]byte(line)); err != nil { // XXX need \n ?
+			action, rewrite := clientPolicy.Eval(cmd.Keyword, cmd.Args)
+			switch action {
+			case PolicyRewrite:
+				log.Printf("rewriting %s to %q", cmd.Keyword, rewrite)
+				if _, err = tc.NetConn().Write([]byte(rewrite + "\r\n")); err != nil {
+					errChan <- err
+				} else if pendingCmds != nil {
+					pendingCmds <- cmd.Keyword
+				}
+			case PolicyAllow:
+				if _, err = tc.NetConn().Write(cmd.Bytes()); err != nil {
+					errChan <- err
+				} else if pendingCmds != nil {
+					pendingCmds <- cmd.Keyword
+				}
+			default:
+				log.Printf("A->T: denied command: [%s]\n", cmd.Keyword)
+				if _, err = writeAppConn([]byte("250 OK\r\n")); err != nil {
 					errChan <- err
-					break
 				}
-				continue
 			}
-
-			log.Printf("A->T: denied command: [%s]\n", lineStr)
-			//if _, err = writeAppConn([]byte(errUnrecognizedCommand)); err != nil {
-			if _, err = writeAppConn([]byte("250 OK\n")); err != nil {
-				errChan <- err
+			if err != nil {
 				break
 			}
 		}
@@ -476,14 +319,33 @@ func main() {
 	var enableLogging bool
 	var logFile string
 	var configFile string
+	var managed bool
 	var filterConfig FilterConfig
 	var err error
 
 	flag.BoolVar(&enableLogging, "enable-logging", false, "enable logging")
 	flag.StringVar(&logFile, "log-file", defaultLogFile, "log file")
 	flag.StringVar(&configFile, "config-file", defaultConfigFile, "filtration config file")
+	flag.BoolVar(&managed, "managed", false, "use the pluggable-transport-style managed configuration protocol")
 	flag.Parse()
 
+	listenAddr := torControlAddr
+	if managed {
+		// In managed mode, the environment and stdout replace -config-file,
+		// -log-file and the fixed listener address.
+		if err := ptNegotiateVersion(); err != nil {
+			os.Exit(1)
+		}
+		stateDir, err := ptStateDir()
+		if err != nil {
+			ptEnvError(err.Error())
+			os.Exit(1)
+		}
+		configFile = ptConfigPath(stateDir)
+		enableLogging = true
+		listenAddr = "127.0.0.1:0"
+	}
+
 	// Deal with filtration configuration.
 	if configFile != "" {
 		file, e := ioutil.ReadFile(configFile)
@@ -498,6 +360,8 @@ func main() {
 	// Deal with logging.
 	if !enableLogging {
 		log.SetOutput(ioutil.Discard)
+	} else if managed {
+		log.SetOutput(ptLogWriter{})
 	} else if logFile != "" {
 		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 		if err != nil {
@@ -511,13 +375,53 @@ func main() {
 		log.Fatalf("Failed to resolve the control port: %s\n", err)
 	}
 
+	var onionMgr *OnionManager
+	if filterConfig.OnionPolicy != nil {
+		onionMgr = NewOnionManager(*filterConfig.OnionPolicy)
+	}
+
+	var identities *AppIdentityRegistry
+	if filterConfig.Socks != nil {
+		identities = NewAppIdentityRegistry()
+		go func() {
+			if err := ServeSocks(*filterConfig.Socks, identities); err != nil {
+				log.Fatalf("SOCKS5 mode failed: %s\n", err)
+			}
+		}()
+	}
+
+	var rateLimiter *RateLimiter
+	if len(filterConfig.RateLimits) > 0 {
+		rateLimiter = NewRateLimiter(filterConfig.RateLimits)
+	}
+
+	var newnymDebouncer *NewnymDebouncer
+	if filterConfig.NewnymDebounce != "" {
+		window, err := time.ParseDuration(filterConfig.NewnymDebounce)
+		if err != nil {
+			log.Fatalf("Failed to parse newnym-debounce: %s\n", err)
+		}
+		newnymDebouncer = NewNewnymDebouncer(window)
+	}
+
+	deps := &filterDeps{
+		onionMgr:        onionMgr,
+		identities:      identities,
+		rateLimiter:     rateLimiter,
+		newnymDebouncer: newnymDebouncer,
+	}
+
 	// Initialize the listener
-	ln, err := net.Listen("tcp", torControlAddr)
+	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen on the filter port: %s\n", err)
 	}
 	defer ln.Close()
 
+	if managed {
+		ptCmethod(ln.Addr().String())
+	}
+
 	// Listen for incoming connections, and dispatch workers.
 	for {
 		conn, err := ln.Accept()
@@ -525,6 +429,6 @@ func main() {
 			log.Printf("Failed to Accept(): %s\n", err)
 			continue
 		}
-		go filterConnection(conn, &filterConfig)
+		go filterConnection(conn, &filterConfig, deps)
 	}
 }
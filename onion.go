@@ -0,0 +1,273 @@
+/*
+ * onion.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/david415/or-ctl-filter/torctl"
+)
+
+// OnionPolicy configures how ADD_ONION, DEL_ONION and ONION_CLIENT_AUTH_ADD
+// are scoped to the connecting application.  Unlike the generic PolicyRule
+// allow/deny match, onion commands need per-client state: which service IDs
+// a client has created, and, optionally, a persisted key so the same
+// caller gets the same onion address across reconnects.
+type OnionPolicy struct {
+	MaxPerClient   int    `json:"max-per-client"`
+	AllowedPorts   []int  `json:"allowed-ports"`
+	ForceDiscardPK bool   `json:"force-discard-pk"`
+	KeyDir         string `json:"key-dir"`
+}
+
+// OnionManager tracks, for each connecting client, which onion service IDs
+// it has created, so that DEL_ONION and ONION_CLIENT_AUTH_ADD can be
+// scoped to services the same client created.  A client is identified by
+// the clientKey its caller passes: filterConnection uses the SOCKS5
+// username recorded for the app in AppIdentityRegistry when one is known,
+// and the control connection's remote address (including its ephemeral
+// port) otherwise, in which case ownership and persisted keys do not carry
+// over to a new connection.
+type OnionManager struct {
+	mu     sync.Mutex
+	policy OnionPolicy
+	owned  map[string]map[string]bool // clientKey -> set of owned ServiceIDs
+}
+
+// NewOnionManager returns an OnionManager enforcing policy.
+func NewOnionManager(policy OnionPolicy) *OnionManager {
+	return &OnionManager{policy: policy, owned: make(map[string]map[string]bool)}
+}
+
+// isOnionCommand reports whether keyword is one of the ephemeral onion
+// service commands that OnionManager scopes per client, rather than the
+// generic PolicyEngine.
+func isOnionCommand(keyword string) bool {
+	switch keyword {
+	case cmdAddOnion, cmdDelOnion, cmdOnionClientAuthAdd:
+		return true
+	}
+	return false
+}
+
+// filterOnionCommand evaluates cmd against onionMgr's per-client scoping
+// for its onion command, returning the (possibly rewritten) command to
+// forward to Tor, or allowed==false if cmd should be denied.
+func filterOnionCommand(onionMgr *OnionManager, clientKey string, cmd *torctl.Cmd) (allowed bool, toSend *torctl.Cmd) {
+	switch cmd.Keyword {
+	case cmdAddOnion:
+		return onionMgr.FilterAddOnion(clientKey, cmd)
+	case cmdDelOnion:
+		if !onionMgr.FilterDelOnion(clientKey, cmd) {
+			return false, nil
+		}
+		return true, cmd
+	case cmdOnionClientAuthAdd:
+		if !onionMgr.FilterOnionClientAuthAdd(clientKey, cmd) {
+			return false, nil
+		}
+		return true, cmd
+	}
+	return false, nil
+}
+
+// FilterAddOnion decides whether clientKey may issue cmd (an ADD_ONION),
+// applying the per-client quota and port allow-list, and forcing Flags or
+// rewriting a NEW:<type> key argument to a persisted key as configured.
+// It returns the (possibly rewritten) command to forward, or allow==false
+// if cmd should be denied.
+func (om *OnionManager) FilterAddOnion(clientKey string, cmd *torctl.Cmd) (allow bool, rewritten *torctl.Cmd) {
+	if len(cmd.Args) == 0 {
+		return false, nil
+	}
+
+	om.mu.Lock()
+	defer om.mu.Unlock()
+
+	if om.policy.MaxPerClient > 0 && len(om.owned[clientKey]) >= om.policy.MaxPerClient {
+		return false, nil
+	}
+
+	args := append([]string(nil), cmd.Args...)
+	if om.policy.AllowedPorts != nil {
+		for _, a := range args[1:] {
+			portArg := strings.TrimPrefix(a, "Port=")
+			if portArg == a {
+				continue
+			}
+			if !om.portAllowed(portArg) {
+				return false, nil
+			}
+		}
+	}
+
+	keySpec := args[0]
+	if om.policy.ForceDiscardPK {
+		args = withFlag(args, "DiscardPK")
+	} else if om.policy.KeyDir != "" && strings.HasPrefix(keySpec, "NEW:") {
+		keyType := normalizeKeyType(strings.TrimPrefix(keySpec, "NEW:"))
+		if stored, err := om.loadKey(clientKey, keyType); err == nil {
+			args[0] = stored
+		}
+	}
+
+	return true, &torctl.Cmd{Keyword: cmd.Keyword, Args: args, Data: cmd.Data}
+}
+
+func (om *OnionManager) portAllowed(portArg string) bool {
+	virtPort := portArg
+	if i := strings.IndexByte(portArg, ','); i >= 0 {
+		virtPort = portArg[:i]
+	}
+	for _, p := range om.policy.AllowedPorts {
+		if strconv.Itoa(p) == virtPort {
+			return true
+		}
+	}
+	return false
+}
+
+// withFlag adds flag to args' "Flags=" argument, creating one if absent,
+// unless it is already present.
+func withFlag(args []string, flag string) []string {
+	for i, a := range args {
+		rest := strings.TrimPrefix(a, "Flags=")
+		if rest == a {
+			continue
+		}
+		for _, f := range strings.Split(rest, ",") {
+			if f == flag {
+				return args
+			}
+		}
+		args[i] = a + "," + flag
+		return args
+	}
+	return append(args, "Flags="+flag)
+}
+
+// bestKeyAlgo is the concrete algorithm ADD_ONION's "BEST" key type alias
+// currently resolves to server-side (control-spec.txt section 3.27).
+const bestKeyAlgo = "ED25519-V3"
+
+// normalizeKeyType resolves a NEW:<type> key type to the concrete
+// algorithm a persisted key is stored under, so that a later NEW:BEST
+// lookup matches a key RecordAddOnionReply saved under the algorithm Tor
+// actually reported (e.g. "ED25519-V3") for an earlier NEW:BEST or
+// NEW:ED25519-V3 request, rather than looking for a file literally named
+// "BEST" that will never exist.
+func normalizeKeyType(keyType string) string {
+	if keyType == "BEST" {
+		return bestKeyAlgo
+	}
+	return keyType
+}
+
+// RecordAddOnionReply attributes a successful ADD_ONION's ServiceID to
+// clientKey, and persists its PrivateKey, if any, so a future NEW:<type>
+// request from the same client can reuse it instead of generating a new
+// onion address.
+func (om *OnionManager) RecordAddOnionReply(clientKey string, reply *torctl.Reply) {
+	if reply.Code() != 250 {
+		return
+	}
+
+	var serviceID, privateKey string
+	for _, line := range reply.Lines {
+		if v := strings.TrimPrefix(line.Text, "ServiceID="); v != line.Text {
+			serviceID = v
+		}
+		if v := strings.TrimPrefix(line.Text, "PrivateKey="); v != line.Text {
+			privateKey = v
+		}
+	}
+	if serviceID == "" {
+		return
+	}
+
+	om.mu.Lock()
+	if om.owned[clientKey] == nil {
+		om.owned[clientKey] = make(map[string]bool)
+	}
+	om.owned[clientKey][serviceID] = true
+	om.mu.Unlock()
+
+	if privateKey == "" || om.policy.KeyDir == "" {
+		return
+	}
+	keyType := privateKey
+	if i := strings.IndexByte(privateKey, ':'); i >= 0 {
+		keyType = privateKey[:i]
+	}
+	if err := om.storeKey(clientKey, keyType, privateKey); err != nil {
+		log.Printf("onion: failed to persist key for %s: %s\n", clientKey, err)
+	}
+}
+
+// FilterDelOnion reports whether clientKey created the service cmd (a
+// DEL_ONION) names, and if so, forgets it.
+func (om *OnionManager) FilterDelOnion(clientKey string, cmd *torctl.Cmd) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	om.mu.Lock()
+	defer om.mu.Unlock()
+	if !om.owned[clientKey][cmd.Args[0]] {
+		return false
+	}
+	delete(om.owned[clientKey], cmd.Args[0])
+	return true
+}
+
+// FilterOnionClientAuthAdd reports whether clientKey created the service
+// cmd (an ONION_CLIENT_AUTH_ADD) names.
+func (om *OnionManager) FilterOnionClientAuthAdd(clientKey string, cmd *torctl.Cmd) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	om.mu.Lock()
+	defer om.mu.Unlock()
+	return om.owned[clientKey][cmd.Args[0]]
+}
+
+func (om *OnionManager) keyPath(clientKey, keyType string) string {
+	safeClient := strings.NewReplacer(":", "_", "/", "_", ".", "_").Replace(clientKey)
+	return filepath.Join(om.policy.KeyDir, safeClient+"-"+keyType+".key")
+}
+
+func (om *OnionManager) storeKey(clientKey, keyType, key string) error {
+	if err := os.MkdirAll(om.policy.KeyDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(om.keyPath(clientKey, keyType), []byte(key), 0600)
+}
+
+func (om *OnionManager) loadKey(clientKey, keyType string) (string, error) {
+	b, err := ioutil.ReadFile(om.keyPath(clientKey, keyType))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
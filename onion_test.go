@@ -0,0 +1,63 @@
+/*
+ * onion_test.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/david415/or-ctl-filter/torctl"
+)
+
+func TestFilterAddOnionReusesPersistedKeyForNewBest(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "or-ctl-filter-onion-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(keyDir)
+
+	om := NewOnionManager(OnionPolicy{KeyDir: keyDir})
+	const clientKey = "client-a"
+
+	// First ADD_ONION NEW:BEST: no persisted key yet, so the spec passes
+	// through unchanged.
+	allow, rewritten := om.FilterAddOnion(clientKey, &torctl.Cmd{Keyword: cmdAddOnion, Args: []string{"NEW:BEST"}})
+	if !allow || rewritten.Args[0] != "NEW:BEST" {
+		t.Fatalf("first NEW:BEST: allow=%v args=%v, want allow=true args[0]=NEW:BEST", allow, rewritten.Args)
+	}
+
+	// Tor resolves BEST to ED25519-V3 and returns the new key.
+	reply := &torctl.Reply{Lines: []torctl.ReplyLine{
+		{Code: 250, Sep: '-', Text: "ServiceID=abcdefghijklmnop"},
+		{Code: 250, Sep: '-', Text: "PrivateKey=ED25519-V3:AAAAKEYDATA"},
+		{Code: 250, Sep: ' ', Text: "OK"},
+	}}
+	om.RecordAddOnionReply(clientKey, reply)
+
+	// A second NEW:BEST from the same client should reuse the persisted
+	// key instead of generating a fresh onion address.
+	allow, rewritten = om.FilterAddOnion(clientKey, &torctl.Cmd{Keyword: cmdAddOnion, Args: []string{"NEW:BEST"}})
+	if !allow {
+		t.Fatal("second NEW:BEST: denied, want allowed")
+	}
+	if want := "ED25519-V3:AAAAKEYDATA"; rewritten.Args[0] != want {
+		t.Errorf("second NEW:BEST: args[0] = %q, want %q (persisted key reused)", rewritten.Args[0], want)
+	}
+}
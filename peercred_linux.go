@@ -0,0 +1,138 @@
+/*
+ * peercred_linux.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lookupPeerPID identifies the local process on the other end of a
+// loopback TCP conn.  There is no SO_PEERCRED for AF_INET sockets (only
+// AF_UNIX), so this instead matches conn against /proc/net/tcp{,6} to
+// find the peer's own socket and its inode, then searches /proc/<pid>/fd
+// for the fd that owns that inode — the same technique tools like `ss -p`
+// use.  It only succeeds for peers running as the same user as
+// or-ctl-filter (or when or-ctl-filter runs as root), which covers the
+// single-desktop deployment this filter targets.
+func lookupPeerPID(conn net.Conn) (int, bool) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+	local, ok := tc.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, false
+	}
+	remote, ok := tc.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, false
+	}
+
+	// The peer's socket has our local/remote addresses reversed.
+	inode, ok := findTCPInode(remote, local)
+	if !ok {
+		return 0, false
+	}
+	return findInodePID(inode)
+}
+
+// findTCPInode scans /proc/net/tcp and /proc/net/tcp6 for the socket bound
+// to local and connected to remote, returning its inode.
+func findTCPInode(local, remote *net.TCPAddr) (string, bool) {
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if inode, ok := scanProcNetTCP(path, local, remote); ok {
+			return inode, true
+		}
+	}
+	return "", false
+}
+
+func scanProcNetTCP(path string, local, remote *net.TCPAddr) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	wantLocal := hexEndpoint(local)
+	wantRemote := hexEndpoint(remote)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // discard the header line
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if fields[1] == wantLocal && fields[2] == wantRemote {
+			return fields[9], true
+		}
+	}
+	return "", false
+}
+
+// hexEndpoint renders addr in /proc/net/tcp's "IP:PORT" hex format: the
+// address bytes in host order, each rendered most-significant-byte-first
+// per 32-bit word, the way the kernel dumps a struct in_addr/in6_addr.
+func hexEndpoint(addr *net.TCPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	var sb strings.Builder
+	for i := 0; i < len(ip); i += 4 {
+		fmt.Fprintf(&sb, "%02X%02X%02X%02X", ip[i+3], ip[i+2], ip[i+1], ip[i])
+	}
+	fmt.Fprintf(&sb, ":%04X", addr.Port)
+	return sb.String()
+}
+
+// findInodePID searches every /proc/<pid>/fd for a socket fd matching
+// inode.
+func findInodePID(inode string) (int, bool) {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, false
+	}
+	want := fmt.Sprintf("socket:[%s]", inode)
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(fdDir + "/" + fd.Name())
+			if err == nil && link == want {
+				return pid, true
+			}
+		}
+	}
+	return 0, false
+}
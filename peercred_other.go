@@ -0,0 +1,30 @@
+//go:build !linux
+
+/*
+ * peercred_other.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "net"
+
+// lookupPeerPID's /proc/net/tcp-based lookup is Linux-specific, so
+// AppIdentityRegistry falls back to keying by remote address on other
+// platforms; see peercred_linux.go.
+func lookupPeerPID(conn net.Conn) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,91 @@
+/*
+ * policy.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PolicyAction is the disposition a PolicyRule assigns to a matching
+// command or reply.
+type PolicyAction string
+
+const (
+	PolicyAllow   PolicyAction = "allow"
+	PolicyDeny    PolicyAction = "deny"
+	PolicyRewrite PolicyAction = "rewrite"
+)
+
+// PolicyRule matches a control protocol command or reply by keyword and,
+// optionally, by a regexp over its joined arguments.  It replaces the old
+// HasPrefix based allow lists, which could be bypassed by extra whitespace
+// or trailing arguments that HasPrefix never inspected.
+type PolicyRule struct {
+	Command    string       `json:"command"`
+	ArgPattern string       `json:"arg-pattern"`
+	Action     PolicyAction `json:"action"`
+	Rewrite    string       `json:"rewrite"`
+
+	argRe *regexp.Regexp
+}
+
+// PolicyEngine evaluates Commands against an ordered list of PolicyRules.
+// The first rule whose Command and ArgPattern both match wins; a command
+// that matches no rule is denied.
+type PolicyEngine struct {
+	rules []*PolicyRule
+}
+
+// NewPolicyEngine compiles rules' ArgPatterns and returns a PolicyEngine
+// that evaluates them in order.
+func NewPolicyEngine(rules []PolicyRule) (*PolicyEngine, error) {
+	pe := &PolicyEngine{}
+	for i := range rules {
+		rule := rules[i]
+		if rule.ArgPattern != "" {
+			re, err := regexp.Compile(rule.ArgPattern)
+			if err != nil {
+				return nil, fmt.Errorf("compiling arg-pattern %q for %s: %s", rule.ArgPattern, rule.Command, err)
+			}
+			rule.argRe = re
+		}
+		pe.rules = append(pe.rules, &rule)
+	}
+	return pe, nil
+}
+
+// Eval returns the action for keyword/args, and, for PolicyRewrite, the
+// rewritten line to substitute for the original.
+func (pe *PolicyEngine) Eval(keyword string, args []string) (PolicyAction, string) {
+	for _, rule := range pe.rules {
+		if rule.Command != keyword {
+			continue
+		}
+		if rule.argRe != nil && !rule.argRe.MatchString(strings.Join(args, " ")) {
+			continue
+		}
+		if rule.Action == PolicyRewrite {
+			return PolicyRewrite, rule.Rewrite
+		}
+		return rule.Action, ""
+	}
+	return PolicyDeny, ""
+}
@@ -0,0 +1,45 @@
+/*
+ * policy_test.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "testing"
+
+func TestPolicyEngineEval(t *testing.T) {
+	pe, err := NewPolicyEngine([]PolicyRule{
+		{Command: "GETINFO", ArgPattern: `^version$`, Action: PolicyAllow},
+		{Command: "GETINFO", Action: PolicyDeny},
+		{Command: "SIGNAL", ArgPattern: `^NEWNYM$`, Action: PolicyRewrite, Rewrite: "250 OK"},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicyEngine: %s", err)
+	}
+
+	if action, _ := pe.Eval("GETINFO", []string{"version"}); action != PolicyAllow {
+		t.Errorf("GETINFO version: got %s, want %s", action, PolicyAllow)
+	}
+	if action, _ := pe.Eval("GETINFO", []string{"config-file"}); action != PolicyDeny {
+		t.Errorf("GETINFO config-file: got %s, want %s", action, PolicyDeny)
+	}
+	if action, rewrite := pe.Eval("SIGNAL", []string{"NEWNYM"}); action != PolicyRewrite || rewrite != "250 OK" {
+		t.Errorf("SIGNAL NEWNYM: got (%s, %q)", action, rewrite)
+	}
+	if action, _ := pe.Eval("GETCONF", []string{"Nickname"}); action != PolicyDeny {
+		t.Errorf("unmatched command: got %s, want %s", action, PolicyDeny)
+	}
+}
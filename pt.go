@@ -0,0 +1,103 @@
+/*
+ * pt.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// managed mode adopts the Tor pluggable-transport managed-proxy protocol
+// (pt-spec.txt section 3) as an alternative to the standalone -config-file
+// and -log-file flags: a parent supervisor (a Tor Browser launcher,
+// sandboxed-tor-browser, Whonix's control-port-filter) sets
+// ptEnvManagedVer/ptEnvStateLocation in the environment, launches
+// or-ctl-filter, and reads the listener address and structured status/error
+// events from its stdout instead of scraping a log file.
+const (
+	ptEnvManagedVer    = "TOR_PT_MANAGED_TRANSPORT_VER"
+	ptEnvStateLocation = "TOR_PT_STATE_LOCATION"
+
+	ptManagedVersion = "1"
+
+	ptMethodName = "or-ctl-filter"
+)
+
+// ptNegotiateVersion reads ptEnvManagedVer and, if it lists a version this
+// binary supports, prints the VERSION line pt-spec.txt requires.  Otherwise
+// it returns an error, after printing ENV-ERROR if ptEnvManagedVer is unset
+// or VERSION-ERROR if it lists no supported version.
+func ptNegotiateVersion() error {
+	versions := os.Getenv(ptEnvManagedVer)
+	if versions == "" {
+		err := fmt.Errorf("%s is not set", ptEnvManagedVer)
+		ptEnvError(err.Error())
+		return err
+	}
+	for _, v := range strings.Split(versions, ",") {
+		if v == ptManagedVersion {
+			fmt.Printf("VERSION %s\n", ptManagedVersion)
+			return nil
+		}
+	}
+	fmt.Println("VERSION-ERROR no-version")
+	return fmt.Errorf("no supported managed transport protocol version in %q", versions)
+}
+
+// ptStateDir returns the directory the supervisor designated for this
+// process's persistent state via ptEnvStateLocation.
+func ptStateDir() (string, error) {
+	dir := os.Getenv(ptEnvStateLocation)
+	if dir == "" {
+		return "", fmt.Errorf("%s is not set", ptEnvStateLocation)
+	}
+	return dir, nil
+}
+
+// ptEnvError reports an unusable managed-proxy environment, per
+// pt-spec.txt section 3.2.
+func ptEnvError(msg string) {
+	fmt.Printf("ENV-ERROR %s\n", msg)
+}
+
+// ptCmethod announces the address or-ctl-filter is listening on for
+// application connections, in the same CMETHOD form a pluggable transport
+// uses to announce its SOCKS listener, followed by CMETHODS DONE.
+func ptCmethod(addr string) {
+	fmt.Printf("CMETHOD %s %s\n", ptMethodName, addr)
+	fmt.Println("CMETHODS DONE")
+}
+
+// ptLogWriter adapts the standard logger to pt-spec.txt's PT-LOG lines, so
+// a supervisor reading or-ctl-filter's stdout gets structured log events
+// instead of having to scrape a log file.
+type ptLogWriter struct{}
+
+func (ptLogWriter) Write(p []byte) (int, error) {
+	fmt.Printf("PT-LOG SEVERITY=notice MESSAGE=%q\n", strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// ptConfigPath returns where a managed or-ctl-filter looks for its JSON
+// filter policy: alongside the rest of the managed transport's state.
+func ptConfigPath(stateDir string) string {
+	return filepath.Join(stateDir, defaultConfigFile)
+}
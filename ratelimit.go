@@ -0,0 +1,172 @@
+/*
+ * ratelimit.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimitSpec configures the token bucket applied to one command
+// keyword, independently for each connecting client.
+type RateLimitSpec struct {
+	PerSecond float64 `json:"per-second"`
+	Burst     int     `json:"burst"`
+	OnExceed  string  `json:"on-exceed"` // "drop", "deny" or "stall"
+}
+
+const (
+	onExceedDrop  = "drop"
+	onExceedDeny  = "deny"
+	onExceedStall = "stall"
+)
+
+// tokenBucket is a classic token bucket: it holds up to burst tokens,
+// refilled at rate tokens/second, and Allow reports whether a token was
+// available to spend.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(spec RateLimitSpec) *tokenBucket {
+	return &tokenBucket{rate: spec.PerSecond, burst: float64(spec.Burst), tokens: float64(spec.Burst), last: time.Now()}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow spends a token if one is available.
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait blocks until a token is available, then spends it.
+func (b *tokenBucket) Wait() {
+	for {
+		b.mu.Lock()
+		b.refill()
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// RateLimiter enforces a RateLimitSpec per (clientKey, command) pair.
+type RateLimiter struct {
+	specs map[string]RateLimitSpec
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewRateLimiter returns a RateLimiter enforcing specs, keyed by command
+// keyword.
+func NewRateLimiter(specs map[string]RateLimitSpec) *RateLimiter {
+	return &RateLimiter{specs: specs, buckets: make(map[string]*tokenBucket)}
+}
+
+func (rl *RateLimiter) bucket(clientKey, command string, spec RateLimitSpec) *tokenBucket {
+	key := fmt.Sprintf("%s|%s", clientKey, command)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = newTokenBucket(spec)
+		rl.buckets[key] = b
+	}
+	return b
+}
+
+// Allow reports whether clientKey may issue command right now.  If not, it
+// also returns the configured OnExceed disposition.  Commands with no
+// configured RateLimitSpec are always allowed.
+func (rl *RateLimiter) Allow(clientKey, command string) (allow bool, onExceed string) {
+	spec, ok := rl.specs[command]
+	if !ok {
+		return true, ""
+	}
+	if rl.bucket(clientKey, command, spec).Allow() {
+		return true, ""
+	}
+	return false, spec.OnExceed
+}
+
+// Wait blocks until clientKey's bucket for command has a token to spend,
+// for the OnExceed == "stall" disposition.
+func (rl *RateLimiter) Wait(clientKey, command string) {
+	spec := rl.specs[command]
+	rl.bucket(clientKey, command, spec).Wait()
+}
+
+// NewnymDebouncer coalesces repeated "SIGNAL NEWNYM" commands from the same
+// client within a configurable window, matching the hardening Whonix's
+// control-port-filter grew for this exact pattern: Tor itself rate-limits
+// NEWNYM to once per 10 seconds, but still runs the full signal handler for
+// every request, so a compromised app issuing it in a loop wastes cycles
+// for no effect.
+type NewnymDebouncer struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// NewNewnymDebouncer returns a NewnymDebouncer that coalesces a NEWNYM
+// signal arriving less than window after the last one forwarded for the
+// same client.
+func NewNewnymDebouncer(window time.Duration) *NewnymDebouncer {
+	return &NewnymDebouncer{window: window, last: make(map[string]time.Time)}
+}
+
+// ShouldCoalesce reports whether clientKey's NEWNYM should be coalesced
+// into the previous one instead of being forwarded to Tor, and records
+// this one as the most recent if not.
+func (d *NewnymDebouncer) ShouldCoalesce(clientKey string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if last, ok := d.last[clientKey]; ok && now.Sub(last) < d.window {
+		return true
+	}
+	d.last[clientKey] = now
+	return false
+}
@@ -0,0 +1,67 @@
+/*
+ * ratelimit_test.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := NewRateLimiter(map[string]RateLimitSpec{
+		"NEWNYM": {PerSecond: 1, Burst: 2, OnExceed: onExceedDeny},
+	})
+
+	for i := 0; i < 2; i++ {
+		if allow, _ := rl.Allow("client-a", "NEWNYM"); !allow {
+			t.Fatalf("burst token %d: got denied, want allowed", i)
+		}
+	}
+	allow, onExceed := rl.Allow("client-a", "NEWNYM")
+	if allow {
+		t.Fatal("third call within burst: got allowed, want denied")
+	}
+	if onExceed != onExceedDeny {
+		t.Errorf("onExceed = %q, want %q", onExceed, onExceedDeny)
+	}
+
+	// A different client gets its own bucket.
+	if allow, _ := rl.Allow("client-b", "NEWNYM"); !allow {
+		t.Fatal("different client: got denied, want allowed")
+	}
+
+	// A command with no configured spec is never limited.
+	if allow, _ := rl.Allow("client-a", "GETINFO"); !allow {
+		t.Fatal("unconfigured command: got denied, want allowed")
+	}
+}
+
+func TestNewnymDebouncerShouldCoalesce(t *testing.T) {
+	d := NewNewnymDebouncer(time.Hour)
+
+	if d.ShouldCoalesce("client-a") {
+		t.Fatal("first signal: got coalesced, want forwarded")
+	}
+	if !d.ShouldCoalesce("client-a") {
+		t.Fatal("second signal within window: got forwarded, want coalesced")
+	}
+	if d.ShouldCoalesce("client-b") {
+		t.Fatal("different client: got coalesced, want forwarded")
+	}
+}
@@ -0,0 +1,388 @@
+/*
+ * socks.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// SocksConfig configures the optional SOCKS5 front end: or-ctl-filter
+// listens on ListenAddr, and for every accepted connection performs the
+// SOCKS5 handshake itself (so it can see the username/password an
+// application authenticates with), then redispatches the connection's
+// payload to Tor's own SOCKSPort at TorSocksAddr, replaying the same
+// username/password so Tor's IsolateSOCKSAuth keeps that application's
+// circuits separate from everyone else's.
+type SocksConfig struct {
+	ListenAddr   string `json:"listen-addr"`
+	TorSocksAddr string `json:"tor-socks-addr"`
+}
+
+const (
+	socksVersion5 = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksUserPassVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded           = 0x00
+	socksRepGeneralFailure      = 0x01
+	socksRepNetworkUnreachable  = 0x03
+	socksRepHostUnreachable     = 0x04
+	socksRepConnectionRefused   = 0x05
+	socksRepCommandNotSupported = 0x07
+)
+
+// AppIdentityRegistry remembers the most recent SOCKS5 username an
+// application authenticated with, keyed by the peer process rather than
+// its source address, so that a control port connection from the same
+// app can be scoped under that identity; see filterConnection's use of
+// clientKey.  A bare source address doesn't distinguish two local apps:
+// the SOCKS5 front end and the control port filter this binary runs are
+// both typically bound to 127.0.0.1, so every app's connections resolve
+// to the same host, just different ephemeral ports on two unrelated
+// connections.
+type AppIdentityRegistry struct {
+	mu    sync.Mutex
+	byKey map[string]string
+}
+
+// NewAppIdentityRegistry returns an empty AppIdentityRegistry.
+func NewAppIdentityRegistry() *AppIdentityRegistry {
+	return &AppIdentityRegistry{byKey: make(map[string]string)}
+}
+
+// peerPID is lookupPeerPID by default; tests stub it to simulate distinct
+// peer processes without needing two separate OS processes.
+var peerPID = lookupPeerPID
+
+// peerKey identifies the process on the other end of conn: its PID, on
+// Linux, and conn's remote address otherwise.  The address fallback
+// includes the ephemeral source port, so it differs for every connection:
+// a username recorded for a SOCKS5 connection is not found by Lookup on a
+// separate control port connection.
+func peerKey(conn net.Conn) string {
+	if pid, ok := peerPID(conn); ok {
+		return fmt.Sprintf("pid:%d", pid)
+	}
+	return conn.RemoteAddr().String()
+}
+
+// Record associates username with the process on the other end of conn.
+func (r *AppIdentityRegistry) Record(conn net.Conn, username string) {
+	key := peerKey(conn)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byKey[key] = username
+}
+
+// Lookup returns the username last recorded for the process on the other
+// end of conn, or "" if none is known.
+func (r *AppIdentityRegistry) Lookup(conn net.Conn) string {
+	key := peerKey(conn)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.byKey[key]
+}
+
+// ServeSocks listens on cfg.ListenAddr and redispatches every connection to
+// cfg.TorSocksAddr, recording each app's SOCKS5 username in identities.
+func ServeSocks(cfg SocksConfig, identities *AppIdentityRegistry) error {
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("listening on SOCKS5 address: %s", err)
+	}
+	log.Printf("Listening for SOCKS5 connections on: %s\n", cfg.ListenAddr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Failed to Accept() SOCKS5 connection: %s\n", err)
+			continue
+		}
+		go handleSocksConn(conn, cfg, identities)
+	}
+}
+
+func handleSocksConn(conn net.Conn, cfg SocksConfig, identities *AppIdentityRegistry) {
+	defer conn.Close()
+
+	username, password, err := socksServerHandshake(conn)
+	if err != nil {
+		log.Printf("SOCKS5 handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	if identities != nil {
+		identities.Record(conn, username)
+	}
+
+	req, err := readSocksRequest(conn)
+	if err != nil {
+		log.Printf("reading SOCKS5 request from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	torConn, err := net.Dial("tcp", cfg.TorSocksAddr)
+	if err != nil {
+		log.Printf("dialing Tor SOCKSPort: %s\n", err)
+		writeSocksReply(conn, dialErrToReplyCode(err))
+		return
+	}
+	defer torConn.Close()
+
+	if err := socksClientHandshake(torConn, username, password); err != nil {
+		log.Printf("SOCKS5 handshake with Tor SOCKSPort: %s\n", err)
+		writeSocksReply(conn, socksRepGeneralFailure)
+		return
+	}
+	if _, err := torConn.Write(req); err != nil {
+		log.Printf("forwarding SOCKS5 request to Tor SOCKSPort: %s\n", err)
+		writeSocksReply(conn, dialErrToReplyCode(err))
+		return
+	}
+
+	reply, err := readSocksReply(torConn)
+	if err != nil {
+		log.Printf("reading SOCKS5 reply from Tor SOCKSPort: %s\n", err)
+		writeSocksReply(conn, socksRepGeneralFailure)
+		return
+	}
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	if reply[1] != socksRepSucceeded {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); io.Copy(torConn, conn) }()
+	go func() { defer wg.Done(); io.Copy(conn, torConn) }()
+	wg.Wait()
+}
+
+// socksServerHandshake performs the server side of a SOCKS5 method
+// negotiation, requiring (and consuming) username/password authentication
+// (RFC 1929), since that is how or-ctl-filter identifies the calling
+// application.
+func socksServerHandshake(conn net.Conn) (username, password string, err error) {
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socksVersion5 {
+		return "", "", fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+
+	haveUserPass := false
+	for _, m := range methods {
+		if m == socksMethodUserPass {
+			haveUserPass = true
+		}
+	}
+	if !haveUserPass {
+		conn.Write([]byte{socksVersion5, socksMethodNoAcceptable})
+		return "", "", fmt.Errorf("client does not support username/password auth")
+	}
+	if _, err = conn.Write([]byte{socksVersion5, socksMethodUserPass}); err != nil {
+		return "", "", err
+	}
+
+	authHdr := make([]byte, 2)
+	if _, err = io.ReadFull(conn, authHdr); err != nil {
+		return "", "", err
+	}
+	if authHdr[0] != socksUserPassVersion {
+		return "", "", fmt.Errorf("unsupported username/password auth version: %d", authHdr[0])
+	}
+	userBuf := make([]byte, authHdr[1])
+	if _, err = io.ReadFull(conn, userBuf); err != nil {
+		return "", "", err
+	}
+	passLen := make([]byte, 1)
+	if _, err = io.ReadFull(conn, passLen); err != nil {
+		return "", "", err
+	}
+	passBuf := make([]byte, passLen[0])
+	if _, err = io.ReadFull(conn, passBuf); err != nil {
+		return "", "", err
+	}
+
+	if _, err = conn.Write([]byte{socksUserPassVersion, 0x00}); err != nil {
+		return "", "", err
+	}
+	return string(userBuf), string(passBuf), nil
+}
+
+// socksClientHandshake performs the client side of a SOCKS5 method
+// negotiation against a real SOCKS5 server (Tor's SOCKSPort), authenticating
+// with username/password so that, with IsolateSOCKSAuth set, Tor keeps this
+// application's circuits separate.
+func socksClientHandshake(conn net.Conn, username, password string) error {
+	if _, err := conn.Write([]byte{socksVersion5, 0x01, socksMethodUserPass}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion5 || resp[1] != socksMethodUserPass {
+		return fmt.Errorf("Tor SOCKSPort rejected username/password auth")
+	}
+
+	req := []byte{socksUserPassVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	authResp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, authResp); err != nil {
+		return err
+	}
+	if authResp[1] != 0x00 {
+		return fmt.Errorf("Tor SOCKSPort authentication failed")
+	}
+	return nil
+}
+
+// readSocksRequest reads a SOCKS5 request (RFC 1928 section 4) and returns
+// its raw bytes, unmodified, for replay to the upstream SOCKSPort.
+func readSocksRequest(conn net.Conn) ([]byte, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socksVersion5 {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+	if hdr[1] != socksCmdConnect {
+		return nil, fmt.Errorf("unsupported SOCKS command: %d", hdr[1])
+	}
+
+	var addr []byte
+	switch hdr[3] {
+	case socksAtypIPv4:
+		addr = make([]byte, 4)
+	case socksAtypIPv6:
+		addr = make([]byte, 16)
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return nil, err
+		}
+		addr = make([]byte, l[0])
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return nil, err
+		}
+		addr = append(l, addr...)
+	default:
+		return nil, fmt.Errorf("unsupported SOCKS address type: %d", hdr[3])
+	}
+	if hdr[3] != socksAtypDomain {
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return nil, err
+		}
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+
+	req := append(hdr, addr...)
+	req = append(req, port...)
+	return req, nil
+}
+
+// readSocksReply reads a SOCKS5 reply (RFC 1928 section 6) and returns its
+// raw bytes, unmodified, for replay back to the application.
+func readSocksReply(conn net.Conn) ([]byte, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+	var addrLen int
+	switch hdr[3] {
+	case socksAtypIPv4:
+		addrLen = 4
+	case socksAtypIPv6:
+		addrLen = 16
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, l[0])
+		addrLen = int(l[0])
+	default:
+		return nil, fmt.Errorf("unsupported SOCKS address type: %d", hdr[3])
+	}
+	rest := make([]byte, addrLen+2) // address, plus 2 byte port
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return nil, err
+	}
+	return append(hdr, rest...), nil
+}
+
+// writeSocksReply sends a minimal SOCKS5 reply with the given reply code
+// and a zeroed BND.ADDR/BND.PORT, for error paths where no upstream reply
+// was ever received to relay verbatim.
+func writeSocksReply(conn net.Conn, code byte) {
+	reply := []byte{socksVersion5, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	conn.Write(reply)
+}
+
+// dialErrToReplyCode translates a failure to reach the upstream SOCKSPort
+// into the SOCKS5 reply code that best describes it, rather than
+// unconditionally reporting "general failure", mirroring the dial error
+// translation in obfs4proxy's SOCKS5 server.
+func dialErrToReplyCode(err error) byte {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return socksRepGeneralFailure
+	}
+	switch {
+	case opErr.Timeout():
+		return socksRepHostUnreachable
+	case opErr.Op == "dial":
+		if _, ok := opErr.Err.(*net.AddrError); ok {
+			return socksRepNetworkUnreachable
+		}
+		return socksRepConnectionRefused
+	default:
+		return socksRepGeneralFailure
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * socks_test.go - or-ctl-filter
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+// dialSelf opens a loopback TCP connection to itself, giving two distinct
+// net.Conn values (one per side) that fall back to distinct RemoteAddr
+// keys, the way two unrelated local apps' connections would.
+func dialSelf(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %s", err)
+	}
+	server = <-accepted
+	return client, server
+}
+
+// TestAppIdentityRegistryRecordLookup exercises the registry's keying
+// logic against a stubbed peerPID: two self-dialed loopback pairs in one
+// test process are both "owned" by this same test binary, so a real
+// lookupPeerPID can't distinguish them and isn't what's under test here
+// (see TestLookupPeerPIDSelf for that). The stub simulates two distinct
+// peer processes the way production traffic from two different apps would
+// actually present.
+func TestAppIdentityRegistryRecordLookup(t *testing.T) {
+	aClient, aServer := dialSelf(t)
+	defer aClient.Close()
+	defer aServer.Close()
+	bClient, bServer := dialSelf(t)
+	defer bClient.Close()
+	defer bServer.Close()
+
+	orig := peerPID
+	defer func() { peerPID = orig }()
+	peerPID = func(conn net.Conn) (int, bool) {
+		switch conn {
+		case aServer:
+			return 101, true
+		case bServer:
+			return 202, true
+		default:
+			return 0, false
+		}
+	}
+
+	reg := NewAppIdentityRegistry()
+	// Record as the control port filter would see it: keyed by the
+	// connection it accepted from the app.
+	reg.Record(aServer, "app-a")
+	reg.Record(bServer, "app-b")
+
+	if got := reg.Lookup(aServer); got != "app-a" {
+		t.Errorf("Lookup(aServer) = %q, want %q", got, "app-a")
+	}
+	if got := reg.Lookup(bServer); got != "app-b" {
+		t.Errorf("Lookup(bServer) = %q, want %q", got, "app-b")
+	}
+	if got := reg.Lookup(aClient); got != "" {
+		t.Errorf("Lookup(aClient) = %q, want \"\"", got)
+	}
+}
+
+// TestLookupPeerPIDSelf exercises the real, unstubbed lookupPeerPID: a
+// self-dialed loopback connection's peer is this very test process, so
+// lookupPeerPID(server) should resolve to os.Getpid() wherever the
+// /proc/net/tcp-based lookup is supported.
+func TestLookupPeerPIDSelf(t *testing.T) {
+	client, server := dialSelf(t)
+	defer client.Close()
+	defer server.Close()
+
+	pid, ok := lookupPeerPID(server)
+	if !ok {
+		t.Skip("lookupPeerPID unsupported on this platform/sandbox")
+	}
+	if pid != os.Getpid() {
+		t.Errorf("lookupPeerPID(server) = %d, want %d (self)", pid, os.Getpid())
+	}
+}
+
+func TestDialErrToReplyCode(t *testing.T) {
+	if got := dialErrToReplyCode(nil); got != socksRepGeneralFailure {
+		t.Errorf("dialErrToReplyCode(nil) = %#x, want %#x", got, socksRepGeneralFailure)
+	}
+
+	opErr := &net.OpError{Op: "dial", Err: &net.AddrError{Err: "bad addr", Addr: "x"}}
+	if got := dialErrToReplyCode(opErr); got != socksRepNetworkUnreachable {
+		t.Errorf("dialErrToReplyCode(AddrError) = %#x, want %#x", got, socksRepNetworkUnreachable)
+	}
+
+	opErr = &net.OpError{Op: "dial", Err: errConnRefused{}}
+	if got := dialErrToReplyCode(opErr); got != socksRepConnectionRefused {
+		t.Errorf("dialErrToReplyCode(other dial err) = %#x, want %#x", got, socksRepConnectionRefused)
+	}
+}
+
+type errConnRefused struct{}
+
+func (errConnRefused) Error() string { return "connection refused" }
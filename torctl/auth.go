@@ -0,0 +1,225 @@
+/*
+ * auth.go - torctl
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package torctl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	cmdProtocolInfo  = "PROTOCOLINFO"
+	cmdAuthenticate  = "AUTHENTICATE"
+	cmdAuthChallenge = "AUTHCHALLENGE"
+
+	argServerHash  = "SERVERHASH="
+	argServerNonce = "SERVERNONCE="
+
+	respProtocolInfoAuth       = "250-AUTH"
+	respProtocolInfoMethods    = "METHODS="
+	respProtocolInfoCookieFile = "COOKIEFILE="
+
+	respAuthChallenge = "250 AUTHCHALLENGE "
+
+	authMethodNull       = "NULL"
+	authMethodCookie     = "COOKIE"
+	authMethodSafeCookie = "SAFECOOKIE"
+
+	authNonceLength   = 32
+	authServerHashKey = "Tor safe cookie authentication server-to-controller hash"
+	authClientHashKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// ProtocolInfo is the parsed response to a PROTOCOLINFO query
+// (control-spec.txt section 3.21).
+type ProtocolInfo struct {
+	AuthMethods []string
+	CookieFile  string
+}
+
+// ProtocolInfo queries the control port for its supported authentication
+// methods and cookie file location.
+func (c *Conn) ProtocolInfo() (*ProtocolInfo, error) {
+	if _, err := c.conn.Write([]byte(cmdProtocolInfo + "\r\n")); err != nil {
+		return nil, fmt.Errorf("writing PROTOCOLINFO request: %s", err)
+	}
+
+	pi := &ProtocolInfo{}
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading PROTOCOLINFO response: %s", err)
+		}
+		lineStr := strings.TrimSpace(string(line))
+		if !strings.HasPrefix(lineStr, "250") {
+			return nil, fmt.Errorf("parsing PROTOCOLINFO response")
+		} else if lineStr == "250 OK" {
+			break
+		}
+		splitResp := strings.SplitN(lineStr, " ", 3)
+		if splitResp[0] != respProtocolInfoAuth {
+			continue
+		}
+		if len(splitResp) == 1 {
+			continue
+		}
+
+		methodsStr := strings.TrimPrefix(splitResp[1], respProtocolInfoMethods)
+		if methodsStr == splitResp[1] {
+			continue
+		}
+		pi.AuthMethods = strings.Split(methodsStr, ",")
+
+		if len(splitResp) == 3 {
+			cookiePathStr := strings.TrimPrefix(splitResp[2], respProtocolInfoCookieFile)
+			if cookiePathStr == splitResp[2] {
+				continue
+			}
+			cookiePath, err := strconv.Unquote(cookiePathStr)
+			if err != nil {
+				continue
+			}
+			pi.CookieFile = cookiePath
+		}
+	}
+	return pi, nil
+}
+
+// supports reports whether the ProtocolInfo lists method among its
+// AuthMethods.
+func (pi *ProtocolInfo) supports(method string) bool {
+	for _, m := range pi.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate authenticates the connection using the strongest method the
+// control port advertises via PROTOCOLINFO: SAFECOOKIE, then COOKIE, then
+// NULL.  It is the equivalent of bulb's Conn.Authenticate, minus password
+// based authentication, which or-ctl-filter has never needed.
+func (c *Conn) Authenticate() error {
+	pi, err := c.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+
+	var authReq []byte
+	switch {
+	case pi.supports(authMethodCookie) || pi.supports(authMethodSafeCookie):
+		if pi.CookieFile == "" {
+			return fmt.Errorf("no cookie file in PROTOCOLINFO response")
+		}
+		cookie, err := readAuthCookie(pi.CookieFile)
+		if err != nil {
+			return err
+		}
+		if pi.supports(authMethodSafeCookie) {
+			cookie, err = c.authSafeCookie(cookie)
+			if err != nil {
+				return err
+			}
+		}
+		authReq = []byte(fmt.Sprintf("%s %s\r\n", cmdAuthenticate, hex.EncodeToString(cookie)))
+	case pi.supports(authMethodNull):
+		authReq = []byte(cmdAuthenticate + "\r\n")
+	default:
+		return fmt.Errorf("no supported authentication methods")
+	}
+
+	if _, err := c.conn.Write(authReq); err != nil {
+		return fmt.Errorf("writing AUTHENTICATE request: %s", err)
+	}
+	if _, err := c.r.ReadBytes('\n'); err != nil {
+		return fmt.Errorf("reading AUTHENTICATE response: %s", err)
+	}
+	return nil
+}
+
+func readAuthCookie(path string) ([]byte, error) {
+	cookie, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading cookie auth file: %s", err)
+	}
+	return cookie, nil
+}
+
+// authSafeCookie performs the AUTHCHALLENGE/SAFECOOKIE handshake
+// (control-spec.txt section 3.24) and returns the resulting ClientHash to
+// be sent as the AUTHENTICATE argument.
+func (c *Conn) authSafeCookie(cookie []byte) ([]byte, error) {
+	clientNonce := make([]byte, authNonceLength)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, fmt.Errorf("generating AUTHCHALLENGE nonce: %s", err)
+	}
+	clientNonceStr := hex.EncodeToString(clientNonce)
+
+	authChallengeReq := []byte(fmt.Sprintf("%s %s %s\r\n", cmdAuthChallenge, authMethodSafeCookie, clientNonceStr))
+	if _, err := c.conn.Write(authChallengeReq); err != nil {
+		return nil, fmt.Errorf("writing AUTHCHALLENGE request: %s", err)
+	}
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading AUTHCHALLENGE response: %s", err)
+	}
+	lineStr := strings.TrimSpace(string(line))
+	respStr := strings.TrimPrefix(lineStr, respAuthChallenge)
+	if respStr == lineStr {
+		return nil, fmt.Errorf("parsing AUTHCHALLENGE response")
+	}
+	splitResp := strings.SplitN(respStr, " ", 2)
+	if len(splitResp) != 2 {
+		return nil, fmt.Errorf("parsing AUTHCHALLENGE response")
+	}
+	hashStr := strings.TrimPrefix(splitResp[0], argServerHash)
+	serverHash, err := hex.DecodeString(hashStr)
+	if err != nil {
+		return nil, fmt.Errorf("decoding AUTHCHALLENGE ServerHash: %s", err)
+	}
+	serverNonceStr := strings.TrimPrefix(splitResp[1], argServerNonce)
+	serverNonce, err := hex.DecodeString(serverNonceStr)
+	if err != nil {
+		return nil, fmt.Errorf("decoding AUTHCHALLENGE ServerNonce: %s", err)
+	}
+
+	// Validate the ServerHash.
+	m := hmac.New(sha256.New, []byte(authServerHashKey))
+	m.Write(cookie)
+	m.Write(clientNonce)
+	m.Write(serverNonce)
+	derivServerHash := m.Sum(nil)
+	if !hmac.Equal(serverHash, derivServerHash) {
+		return nil, fmt.Errorf("AUTHCHALLENGE ServerHash is invalid")
+	}
+
+	// Calculate the ClientHash.
+	m = hmac.New(sha256.New, []byte(authClientHashKey))
+	m.Write(cookie)
+	m.Write(clientNonce)
+	m.Write(serverNonce)
+	return m.Sum(nil), nil
+}
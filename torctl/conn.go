@@ -0,0 +1,83 @@
+/*
+ * conn.go - torctl
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package torctl
+
+import (
+	"bufio"
+	"net"
+)
+
+// Conn is a connection to a Tor control port.  It wraps a net.Conn with
+// the buffering needed by ReadCmd/ReadReply, and the authentication and
+// event dispatch helpers below.  It is deliberately similar in shape to
+// yawning/bulb's Conn and LND's tor.Controller, so that programs which
+// embed or-ctl-filter (sandbox launchers, custom Tor Browser bundles) can
+// also use it to talk to the control port directly.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// asyncEvents is non-nil once StartEventListener has been called; from
+	// that point on, Conn owns reading from r and Cmd must not be used.
+	asyncEvents chan *Reply
+}
+
+// NewConn wraps conn for use as a Tor control port connection.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Dial connects to a Tor control port at addr using network (e.g. "unix"
+// or "tcp"), and returns a Conn wrapping it.
+func Dial(network, addr string) (*Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NetConn returns the underlying net.Conn, for callers that need to Close
+// it or inspect its addresses.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Reader returns the buffered reader Conn reads from.  A caller that takes
+// over raw protocol handling after Authenticate (as or-ctl-filter's own
+// proxy loop does) must keep using this same *bufio.Reader, since it may
+// already hold buffered, unread bytes.
+func (c *Conn) Reader() *bufio.Reader {
+	return c.r
+}
+
+// Cmd sends a command and returns its reply.  It must not be called after
+// StartEventListener, which takes over reading from the connection.
+func (c *Conn) Cmd(keyword string, args ...string) (*Reply, error) {
+	cmd := &Cmd{Keyword: keyword, Args: args}
+	if _, err := c.conn.Write(cmd.Bytes()); err != nil {
+		return nil, err
+	}
+	return ReadReply(c.r)
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
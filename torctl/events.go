@@ -0,0 +1,57 @@
+/*
+ * events.go - torctl
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package torctl
+
+// asyncReplyCode is the status code Tor uses for asynchronous event
+// notifications sent in response to SETEVENTS (control-spec.txt section
+// 4).
+const asyncReplyCode = 650
+
+// StartEventListener takes over reading from the connection and returns a
+// channel of asynchronous (650) event replies.  It is meant for callers
+// that have already issued SETEVENTS and want the events alone, not the
+// raw proxying or-ctl-filter's own forwarding loop does; after calling
+// this, Cmd must not be used, since there is no longer a synchronous
+// reader to hand non-event replies back to.
+//
+// The returned channel is closed, after which the listener goroutine
+// exits, when the connection is closed or a read error occurs.
+func (c *Conn) StartEventListener() <-chan *Reply {
+	events := make(chan *Reply, 16)
+	c.asyncEvents = events
+
+	go func() {
+		defer close(events)
+		for {
+			reply, err := ReadReply(c.r)
+			if err != nil {
+				return
+			}
+			if reply.Code() != asyncReplyCode {
+				// A non-event reply with no synchronous caller waiting on
+				// it; the dispatcher has nowhere to deliver it, so it is
+				// dropped.
+				continue
+			}
+			events <- reply
+		}
+	}()
+
+	return events
+}
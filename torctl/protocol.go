@@ -0,0 +1,271 @@
+/*
+ * protocol.go - torctl
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package torctl is a small library for speaking the Tor control protocol
+// (control-spec.txt), in the spirit of yawning/bulb.  It exposes the
+// command/reply parser, the SAFECOOKIE/cookie/null authentication dance,
+// and an async event dispatcher, so that programs other than or-ctl-filter
+// itself can drive a control port connection.
+package torctl
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// Cmd is a single, possibly multi-line, Tor control protocol command as
+// sent by a controller (control-spec.txt section 2.3).  Keyword is the
+// first, space delimited token (e.g. "GETINFO" or "SIGNAL"), Args are the
+// remaining tokens with quoting removed, and Data holds the lines of a
+// CmdData block for "+"-prefixed multi-line commands such as
+// "+POSTDESCRIPTOR".
+type Cmd struct {
+	Keyword string
+	Args    []string
+	Data    []string
+}
+
+// Bytes renders a Cmd back into wire format, including its CmdData block,
+// if any.  A Key=Value argument is rendered with only its value quoted
+// (Nickname="My Relay"), and a data line starting with "." is escaped as
+// "..".
+func (c *Cmd) Bytes() []byte {
+	var sb strings.Builder
+	if c.Data != nil {
+		sb.WriteByte('+')
+	}
+	sb.WriteString(c.Keyword)
+	for _, arg := range c.Args {
+		sb.WriteByte(' ')
+		if i := strings.IndexByte(arg, '='); i > 0 && !strings.ContainsAny(arg[:i], " \"\\") {
+			sb.WriteString(arg[:i+1])
+			sb.WriteString(quoteArg(arg[i+1:]))
+		} else {
+			sb.WriteString(quoteArg(arg))
+		}
+	}
+	sb.WriteString("\r\n")
+	for _, line := range c.Data {
+		if strings.HasPrefix(line, ".") {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(line)
+		sb.WriteString("\r\n")
+	}
+	if c.Data != nil {
+		sb.WriteString(".\r\n")
+	}
+	return []byte(sb.String())
+}
+
+// ReplyLine is one line of a Tor control protocol reply: a three digit
+// status code, a separator ('-' for a mid-reply line, '+' for a mid-reply
+// line followed by a CmdData block, ' ' for the final line of the reply),
+// and the line's text.
+type ReplyLine struct {
+	Code int
+	Sep  byte
+	Text string
+	Data []string
+}
+
+// Reply is a complete Tor control protocol reply: one or more ReplyLines,
+// the last of which has Sep == ' '.
+type Reply struct {
+	Lines []ReplyLine
+}
+
+// Code returns the status code of a Reply's final line, which is the code
+// that governs the whole reply (control-spec.txt section 3.1).
+func (r *Reply) Code() int {
+	if len(r.Lines) == 0 {
+		return 0
+	}
+	return r.Lines[len(r.Lines)-1].Code
+}
+
+// Bytes renders a Reply back into wire format, escaping a data line that
+// starts with "." as "..".
+func (r *Reply) Bytes() []byte {
+	var sb strings.Builder
+	for _, line := range r.Lines {
+		fmt.Fprintf(&sb, "%03d%c%s\r\n", line.Code, line.Sep, line.Text)
+		for _, dl := range line.Data {
+			if strings.HasPrefix(dl, ".") {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(dl)
+			sb.WriteString("\r\n")
+		}
+		if line.Data != nil {
+			sb.WriteString(".\r\n")
+		}
+	}
+	return []byte(sb.String())
+}
+
+// ReadCmd reads a single, possibly multi-line, Cmd from r.
+func ReadCmd(r *bufio.Reader) (*Cmd, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	isData := strings.HasPrefix(line, "+")
+	keyword, args := tokenizeLine(strings.TrimPrefix(line, "+"))
+	cmd := &Cmd{Keyword: keyword, Args: args}
+
+	if isData {
+		data, err := readCmdData(r)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Data = data
+	}
+	return cmd, nil
+}
+
+// ReadReply reads a single, possibly multi-line, Reply from r.
+func ReadReply(r *bufio.Reader) (*Reply, error) {
+	reply := &Reply{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed reply line: %q", line)
+		}
+
+		var code int
+		if _, err := fmt.Sscanf(line[:3], "%03d", &code); err != nil {
+			return nil, fmt.Errorf("malformed reply status code: %q", line)
+		}
+		sep := line[3]
+		rl := ReplyLine{Code: code, Sep: sep, Text: line[4:]}
+
+		if sep == '+' {
+			data, err := readCmdData(r)
+			if err != nil {
+				return nil, err
+			}
+			rl.Data = data
+		}
+		reply.Lines = append(reply.Lines, rl)
+
+		if sep == ' ' {
+			break
+		}
+		if sep != '-' && sep != '+' {
+			return nil, fmt.Errorf("malformed reply separator: %q", line)
+		}
+	}
+	return reply, nil
+}
+
+// readCmdData reads a CmdData block: zero or more lines, terminated by a
+// line containing a single ".", with a leading "." on a data line escaped
+// as ".." (control-spec.txt section 2.3).
+func readCmdData(r *bufio.Reader) ([]string, error) {
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			return data, nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		data = append(data, line)
+	}
+}
+
+// quoteArg renders arg as a bare word if it needs no quoting, or as a
+// QuotedString (escaping "\\" and "\"" as in C string literals) if it
+// contains a space, quote or backslash, the inverse of the unquoting
+// tokenize does on input.
+func quoteArg(arg string) string {
+	if !strings.ContainsAny(arg, " \"\\") {
+		return arg
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == '"' || arg[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(arg[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// tokenizeLine splits a control protocol line into its keyword and
+// arguments.  Arguments may be bare words or QuotedStrings (DQUOTE
+// *qcontent DQUOTE, with "\\" and "\"" escaped as in C string literals);
+// quoting is removed from the returned tokens.
+func tokenizeLine(line string) (keyword string, args []string) {
+	tokens := tokenize(line)
+	if len(tokens) == 0 {
+		return "", nil
+	}
+	return tokens[0], tokens[1:]
+}
+
+// tokenize splits line on unquoted spaces into tokens, removing quoting
+// from any QuotedStrings found along the way.  A quote need not start a
+// token: control-spec.txt commands routinely mix bare and quoted content
+// in one argument (e.g. SETCONF's Nickname="My Relay"), so quoting is
+// recognized wherever it appears within a token, not just at its start.
+func tokenize(line string) []string {
+	var tokens []string
+	i, n := 0, len(line)
+	for i < n {
+		for i < n && line[i] == ' ' {
+			i++
+		}
+		if i >= n {
+			break
+		}
+		var sb strings.Builder
+		inQuotes := false
+		for i < n && (inQuotes || line[i] != ' ') {
+			switch {
+			case line[i] == '"':
+				inQuotes = !inQuotes
+				i++
+			case inQuotes && line[i] == '\\' && i+1 < n:
+				i++
+				sb.WriteByte(line[i])
+				i++
+			default:
+				sb.WriteByte(line[i])
+				i++
+			}
+		}
+		tokens = append(tokens, sb.String())
+	}
+	return tokens
+}
@@ -0,0 +1,104 @@
+/*
+ * protocol_test.go - torctl
+ * Copyright (C) 2014  Yawning Angel
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package torctl
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`GETINFO version`, []string{"GETINFO", "version"}},
+		{`AUTHENTICATE "hello world"`, []string{"AUTHENTICATE", "hello world"}},
+		{`SETCONF Nickname="My Relay"`, []string{"SETCONF", "Nickname=My Relay"}},
+		{`SETCONF Nickname="My Relay" ORPort=9001`, []string{"SETCONF", "Nickname=My Relay", "ORPort=9001"}},
+		{`SETCONF Foo="a\"b"`, []string{"SETCONF", `Foo=a"b`}},
+	}
+	for _, tc := range tests {
+		got := tokenize(tc.line)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("tokenize(%q) = %#v, want %#v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestReadCmdAndBytesRoundTrip(t *testing.T) {
+	const wire = "SETCONF Nickname=\"My Relay\"\r\n"
+	cmd, err := ReadCmd(bufio.NewReader(strings.NewReader(wire)))
+	if err != nil {
+		t.Fatalf("ReadCmd: %s", err)
+	}
+	if cmd.Keyword != "SETCONF" || !reflect.DeepEqual(cmd.Args, []string{"Nickname=My Relay"}) {
+		t.Fatalf("ReadCmd parsed %+v", cmd)
+	}
+	if got := string(cmd.Bytes()); got != wire {
+		t.Errorf("Cmd.Bytes() = %q, want %q", got, wire)
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"bare", "bare"},
+		{"Nickname=My Relay", `"Nickname=My Relay"`},
+		{`a"b`, `"a\"b"`},
+		{`a\b`, `"a\\b"`},
+	}
+	for _, tc := range tests {
+		if got := quoteArg(tc.arg); got != tc.want {
+			t.Errorf("quoteArg(%q) = %q, want %q", tc.arg, got, tc.want)
+		}
+	}
+}
+
+func TestReadCmdDataRoundTrip(t *testing.T) {
+	const wire = "+POSTDESCRIPTOR\r\nrouter foo\r\nbar\r\n.\r\n"
+	cmd, err := ReadCmd(bufio.NewReader(strings.NewReader(wire)))
+	if err != nil {
+		t.Fatalf("ReadCmd: %s", err)
+	}
+	if cmd.Keyword != "POSTDESCRIPTOR" || !reflect.DeepEqual(cmd.Data, []string{"router foo", "bar"}) {
+		t.Fatalf("ReadCmd parsed %+v", cmd)
+	}
+	if got := string(cmd.Bytes()); got != wire {
+		t.Errorf("Cmd.Bytes() = %q, want %q", got, wire)
+	}
+}
+
+func TestReadReplyRoundTrip(t *testing.T) {
+	const wire = "250-ServiceID=abc\r\n250 OK\r\n"
+	reply, err := ReadReply(bufio.NewReader(strings.NewReader(wire)))
+	if err != nil {
+		t.Fatalf("ReadReply: %s", err)
+	}
+	if reply.Code() != 250 {
+		t.Errorf("Code() = %d, want 250", reply.Code())
+	}
+	if got := string(reply.Bytes()); got != wire {
+		t.Errorf("Reply.Bytes() = %q, want %q", got, wire)
+	}
+}